@@ -22,6 +22,8 @@ package sync2
 
 import (
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 // Semaphore is a counting semaphore with the option to
@@ -61,6 +63,29 @@ func (sem *Semaphore) Acquire() bool {
 	}
 }
 
+// AcquireContext returns true on successful acquisition, and
+// false on a timeout or if ctx is done first.
+func (sem *Semaphore) AcquireContext(ctx context.Context) bool {
+	if sem.timeout == 0 {
+		select {
+		case <-sem.slots:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	tm := time.NewTimer(sem.timeout)
+	defer tm.Stop()
+	select {
+	case <-sem.slots:
+		return true
+	case <-tm.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
 // TryAcquire acquires a semaphore if it's immediately available.
 // It returns false otherwise.
 func (sem *Semaphore) TryAcquire() bool {
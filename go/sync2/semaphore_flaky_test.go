@@ -19,6 +19,8 @@ package sync2
 import (
 	"testing"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 func TestSemaNoTimeout(t *testing.T) {
@@ -52,6 +54,20 @@ func TestSemaTimeout(t *testing.T) {
 	}
 }
 
+func TestSemaAcquireContext(t *testing.T) {
+	s := NewSemaphore(1, 0)
+	s.Acquire()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if s.AcquireContext(ctx) {
+		t.Errorf("AcquireContext: true, want false")
+	}
+	s.Release()
+	if !s.AcquireContext(context.Background()) {
+		t.Errorf("AcquireContext: false, want true")
+	}
+}
+
 func TestSemaTryAcquire(t *testing.T) {
 	s := NewSemaphore(1, 0)
 	if !s.TryAcquire() {
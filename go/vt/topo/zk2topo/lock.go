@@ -97,9 +97,17 @@ func (zs *Server) Lock(ctx context.Context, dirPath, contents string) (topo.Lock
 }
 
 // Check is part of the topo.LockDescriptor interface.
+// We'd lose the ephemeral node in case of a session loss, so we
+// make sure it is still there.
 func (ld *zkLockDescriptor) Check(ctx context.Context) error {
-	// TODO(alainjobart): check the connection has not been interrupted.
-	// We'd lose the ephemeral node in case of a session loss.
+	zkPath := path.Join(ld.zs.root, ld.nodePath)
+	exists, _, err := ld.zs.conn.Exists(ctx, zkPath)
+	if err != nil {
+		return convertError(err, zkPath)
+	}
+	if !exists {
+		return fmt.Errorf("lock node %v is gone, the zk session was most likely lost", zkPath)
+	}
 	return nil
 }
 
@@ -17,12 +17,22 @@ limitations under the License.
 package zk2topo
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/samuel/go-zookeeper/zk"
 	"golang.org/x/net/context"
 
+	"vitess.io/vitess/go/json2"
 	"vitess.io/vitess/go/testfiles"
 	"vitess.io/vitess/go/vt/topo"
 	"vitess.io/vitess/go/vt/topo/test"
@@ -62,6 +72,25 @@ func TestZk2Topo(t *testing.T) {
 
 		return ts
 	})
+
+	// Run the zk2topo specific tests, each in its own root.
+	testLockCheck(t, serverAddr)
+	testChildrenMulti(t, serverAddr)
+	testCompareAndSet(t, serverAddr)
+	testJSON(t, serverAddr)
+	testConnClose(t, serverAddr)
+	testChildrenWithData(t, serverAddr)
+	testListEphemeralChildren(t, serverAddr)
+	testRetryChange(t, serverAddr)
+	testCreateIfNotExists(t, serverAddr)
+	testActiveSessions(t, serverAddr)
+	testExistsMulti(t, serverAddr)
+	testWaitForValue(t, serverAddr)
+	testMulti(t, serverAddr)
+	testAuth(t, serverAddr)
+	testNumChildren(t, serverAddr)
+	testChangedChildren(t, serverAddr)
+	testDialStats(t, serverAddr)
 }
 
 func TestHasObservers(t *testing.T) {
@@ -75,3 +104,796 @@ func TestHasObservers(t *testing.T) {
 		t.Errorf("hasObservers(s1:p1,s2:p2|o1:p1,o2:p2): got unexpected %v %v %v", s1, s2, ok)
 	}
 }
+
+// testLockCheck makes sure zkLockDescriptor.Check notices when the
+// lock node disappears, like it would if the session were lost.
+func testLockCheck(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	zs := NewServer(serverAddr, "/test-lock-check")
+	defer zs.Close()
+
+	if _, err := CreateRecursive(ctx, zs.conn, "/test-lock-check/keyspace", nil, 0, zk.WorldACL(PermDirectory), -1); err != nil {
+		t.Fatalf("CreateRecursive failed: %v", err)
+	}
+	ld, err := zs.Lock(ctx, "keyspace", "lock contents")
+	if err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if err := ld.Check(ctx); err != nil {
+		t.Errorf("Check on held lock failed: %v", err)
+	}
+
+	nodePath := path.Join(zs.root, ld.(*zkLockDescriptor).nodePath)
+	if err := zs.conn.Delete(ctx, nodePath, -1); err != nil {
+		t.Fatalf("Delete(%v) failed: %v", nodePath, err)
+	}
+	if err := ld.Check(ctx); err == nil {
+		t.Errorf("Check after lock node deletion: got no error, want one")
+	}
+}
+
+// testChildrenMulti tests ChildrenMulti with partial errors, various
+// parallelism values, and a cancelled context.
+func testChildrenMulti(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	conn := Connect(serverAddr)
+	defer conn.Close()
+
+	root := "/test-children-multi"
+	for _, p := range []string{"a/1", "a/2", "b/1"} {
+		if _, err := CreateRecursive(ctx, conn, path.Join(root, p), nil, 0, zk.WorldACL(PermDirectory), -1); err != nil {
+			t.Fatalf("CreateRecursive(%v) failed: %v", p, err)
+		}
+	}
+	zkPaths := []string{root + "/a", root + "/b", root + "/missing"}
+
+	want := map[string][]string{
+		root + "/a": {"1", "2"},
+		root + "/b": {"1"},
+	}
+	for _, parallelism := range []int{-1, 0, 1, 2, 10} {
+		results, errs := ChildrenMulti(ctx, conn, zkPaths, parallelism)
+		for _, children := range results {
+			sort.Strings(children)
+		}
+		if !reflect.DeepEqual(results, want) {
+			t.Errorf("ChildrenMulti(parallelism=%v): got %v, want %v", parallelism, results, want)
+		}
+		if len(errs) != 1 || errs[root+"/missing"] != zk.ErrNoNode {
+			t.Errorf("ChildrenMulti(parallelism=%v): got errors %v, want only %v for %v/missing", parallelism, errs, zk.ErrNoNode, root)
+		}
+	}
+
+	// Nothing is read with a cancelled context.
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	results, errs := ChildrenMulti(cancelledCtx, conn, zkPaths, 1)
+	if len(results) != 0 {
+		t.Errorf("ChildrenMulti with cancelled context: got results %v, want none", results)
+	}
+	for _, zkPath := range zkPaths {
+		if errs[zkPath] != context.Canceled {
+			t.Errorf("ChildrenMulti with cancelled context: got error %v for %v, want %v", errs[zkPath], zkPath, context.Canceled)
+		}
+	}
+}
+
+// testCompareAndSet tests CompareAndSet, including a version conflict
+// forced by writing the node from inside transform.
+func testCompareAndSet(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	conn := Connect(serverAddr)
+	defer conn.Close()
+
+	zkPath := "/test-compare-and-set/node"
+	if _, err := CreateRecursive(ctx, conn, zkPath, []byte("1"), 0, zk.WorldACL(PermFile), -1); err != nil {
+		t.Fatalf("CreateRecursive failed: %v", err)
+	}
+
+	var seen []string
+	err := CompareAndSet(ctx, conn, zkPath, func(oldValue []byte, version int32) ([]byte, error) {
+		seen = append(seen, string(oldValue))
+		if len(seen) == 1 {
+			// Someone else changes the node in the meantime.
+			if _, err := conn.Set(ctx, zkPath, []byte("2"), version); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+		}
+		return append(oldValue, '+'), nil
+	})
+	if err != nil {
+		t.Fatalf("CompareAndSet failed: %v", err)
+	}
+	if want := []string{"1", "2"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("CompareAndSet: transform got %v, want %v", seen, want)
+	}
+	data, _, err := conn.Get(ctx, zkPath)
+	if err != nil || string(data) != "2+" {
+		t.Errorf("Get after CompareAndSet: got %q %v, want %q", data, err, "2+")
+	}
+
+	// Errors from transform and from the read are returned as is.
+	transformErr := errors.New("transform error")
+	if err := CompareAndSet(ctx, conn, zkPath, func([]byte, int32) ([]byte, error) {
+		return nil, transformErr
+	}); err != transformErr {
+		t.Errorf("CompareAndSet with failing transform: got %v, want %v", err, transformErr)
+	}
+	if err := CompareAndSet(ctx, conn, zkPath+"-missing", func(oldValue []byte, _ int32) ([]byte, error) {
+		return oldValue, nil
+	}); err != zk.ErrNoNode {
+		t.Errorf("CompareAndSet on missing node: got %v, want %v", err, zk.ErrNoNode)
+	}
+}
+
+// testJSON makes sure SetJSON and GetJSON encode protos the same way.
+func testJSON(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	conn := Connect(serverAddr)
+	defer conn.Close()
+
+	zkPath := "/test-json/node"
+	if _, err := CreateRecursive(ctx, conn, zkPath, nil, 0, zk.WorldACL(PermFile), -1); err != nil {
+		t.Fatalf("CreateRecursive failed: %v", err)
+	}
+
+	ci := &topodatapb.CellInfo{
+		ServerAddress: "server:1234",
+		Root:          "/root",
+	}
+	if err := SetJSON(ctx, conn, zkPath, ci, -1); err != nil {
+		t.Fatalf("SetJSON failed: %v", err)
+	}
+	data, _, err := conn.Get(ctx, zkPath)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	want, err := json2.MarshalPB(ci)
+	if err != nil {
+		t.Fatalf("MarshalPB failed: %v", err)
+	}
+	if string(data) != string(want) {
+		t.Errorf("SetJSON stored %s, want %s", data, want)
+	}
+
+	got := &topodatapb.CellInfo{}
+	if _, err := GetJSON(ctx, conn, zkPath, got); err != nil {
+		t.Fatalf("GetJSON failed: %v", err)
+	}
+	if !proto.Equal(got, ci) {
+		t.Errorf("GetJSON: got %v, want %v", got, ci)
+	}
+}
+
+// testConnClose makes sure a closed ZkConn fails right away, both for
+// new operations and for the ones running when Close is called.
+func testConnClose(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	conn := Connect(serverAddr)
+	if _, _, err := conn.Exists(ctx, "/"); err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+
+	// An operation running during Close doesn't wait for a retry.
+	var closedAt time.Time
+	err := conn.withRetry(ctx, func(zconn *zk.Conn) error {
+		conn.Close()
+		closedAt = time.Now()
+		return zk.ErrConnectionClosed
+	})
+	if err != ErrConnClosed {
+		t.Errorf("operation running during Close: got %v, want %v", err, ErrConnClosed)
+	}
+	if d := time.Since(closedAt); d >= time.Second {
+		t.Errorf("operation running during Close took %v, expected no retry backoff", d)
+	}
+
+	// Operations after Close fail, and don't connect again.
+	dials := dialSuccesses.Counts()[serverAddr] + dialErrors.Counts()[serverAddr]
+	if _, _, err := conn.Get(ctx, "/"); err != ErrConnClosed {
+		t.Errorf("Get after Close: got %v, want %v", err, ErrConnClosed)
+	}
+	if _, err := conn.Create(ctx, "/test-conn-close", nil, 0, zk.WorldACL(PermFile)); err != ErrConnClosed {
+		t.Errorf("Create after Close: got %v, want %v", err, ErrConnClosed)
+	}
+	if got := dialSuccesses.Counts()[serverAddr] + dialErrors.Counts()[serverAddr]; got != dials {
+		t.Errorf("operations after Close dialed again: got %v dials, want %v", got, dials)
+	}
+}
+
+// testChildrenWithData tests ChildrenWithData, including while the
+// children are being deleted.
+func testChildrenWithData(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	conn := Connect(serverAddr)
+	defer conn.Close()
+
+	root := "/test-children-with-data"
+	want := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		child := fmt.Sprintf("child%v", i)
+		want[child] = []byte(fmt.Sprintf("data%v", i))
+		if _, err := CreateRecursive(ctx, conn, path.Join(root, child), want[child], 0, zk.WorldACL(PermFile), -1); err != nil {
+			t.Fatalf("CreateRecursive(%v) failed: %v", child, err)
+		}
+	}
+
+	for _, parallelism := range []int{-1, 0, 1, 5} {
+		got, err := ChildrenWithData(ctx, conn, root, parallelism)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ChildrenWithData(parallelism=%v): got %v %v, want %v", parallelism, got, err, want)
+		}
+	}
+
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := ChildrenWithData(cancelledCtx, conn, root, 1); err != context.Canceled {
+		t.Errorf("ChildrenWithData with cancelled context: got %v, want %v", err, context.Canceled)
+	}
+
+	// Delete the children while we read them: they can be
+	// missing from the result, but it's never an error.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for child := range want {
+			if err := conn.Delete(ctx, path.Join(root, child), -1); err != nil {
+				t.Errorf("Delete(%v) failed: %v", child, err)
+			}
+		}
+	}()
+	for deleting := true; deleting; {
+		select {
+		case <-done:
+			deleting = false
+		default:
+		}
+		got, err := ChildrenWithData(ctx, conn, root, 2)
+		if err != nil {
+			t.Errorf("ChildrenWithData during deletion failed: %v", err)
+			break
+		}
+		for child, data := range got {
+			if string(data) != string(want[child]) {
+				t.Errorf("ChildrenWithData during deletion: got %q for %v, want %q", data, child, want[child])
+			}
+		}
+	}
+	<-done
+}
+
+// testListEphemeralChildren tests ListEphemeralChildren with a mix of
+// ephemeral and persistent children.
+func testListEphemeralChildren(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	conn := Connect(serverAddr)
+	defer conn.Close()
+
+	root := "/test-list-ephemeral-children"
+	for _, child := range []string{"p1", "e1", "p2", "e2"} {
+		var flags int32
+		if child[0] == 'e' {
+			flags = zk.FlagEphemeral
+		}
+		if _, err := CreateRecursive(ctx, conn, path.Join(root, child), nil, flags, zk.WorldACL(PermFile), -1); err != nil {
+			t.Fatalf("CreateRecursive(%v) failed: %v", child, err)
+		}
+	}
+
+	want := []string{"e1", "e2"}
+	for _, parallelism := range []int{-1, 0, 1, 3} {
+		got, err := ListEphemeralChildren(ctx, conn, root, parallelism)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ListEphemeralChildren(parallelism=%v): got %v %v, want %v", parallelism, got, err, want)
+		}
+	}
+}
+
+// testRetryChange tests the create, update and conflict paths of
+// RetryChange.
+func testRetryChange(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	conn := Connect(serverAddr)
+	defer conn.Close()
+
+	zkPath := "/test-retry-change/node"
+	if _, err := CreateRecursive(ctx, conn, path.Dir(zkPath), nil, 0, zk.WorldACL(PermDirectory), -1); err != nil {
+		t.Fatalf("CreateRecursive failed: %v", err)
+	}
+	aclv := zk.WorldACL(PermFile)
+
+	deleteNode := func() {
+		if err := conn.Delete(ctx, zkPath, -1); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	testcases := []struct {
+		name  string
+		setup func()
+		// conflict is called during the first changeFunc call,
+		// to modify the node behind RetryChange's back.
+		conflict func()
+		want     []string
+		value    string
+	}{{
+		name:  "create",
+		want:  []string{"<none>"},
+		value: "<none>+",
+	}, {
+		name:  "update",
+		want:  []string{"<none>+"},
+		value: "<none>++",
+	}, {
+		name: "update conflict",
+		conflict: func() {
+			if _, err := conn.Set(ctx, zkPath, []byte("other"), -1); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+		},
+		want:  []string{"<none>++", "other"},
+		value: "other+",
+	}, {
+		name:     "delete conflict",
+		conflict: deleteNode,
+		want:     []string{"other+", "<none>"},
+		value:    "<none>+",
+	}, {
+		name:  "create conflict",
+		setup: deleteNode,
+		conflict: func() {
+			if _, err := conn.Create(ctx, zkPath, []byte("created"), 0, aclv); err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+		},
+		want:  []string{"<none>", "created"},
+		value: "created+",
+	}}
+	for _, tcase := range testcases {
+		if tcase.setup != nil {
+			tcase.setup()
+		}
+
+		var seen []string
+		err := RetryChange(ctx, conn, zkPath, 0, aclv, func(oldValue []byte, stat *zk.Stat) ([]byte, error) {
+			value := "<none>"
+			if stat != nil {
+				value = string(oldValue)
+			}
+			seen = append(seen, value)
+			if len(seen) == 1 && tcase.conflict != nil {
+				tcase.conflict()
+			}
+			return []byte(value + "+"), nil
+		})
+		if err != nil {
+			t.Errorf("RetryChange(%v) failed: %v", tcase.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(seen, tcase.want) {
+			t.Errorf("RetryChange(%v): changeFunc got %v, want %v", tcase.name, seen, tcase.want)
+		}
+		data, _, err := conn.Get(ctx, zkPath)
+		if err != nil || string(data) != tcase.value {
+			t.Errorf("RetryChange(%v): got value %q %v, want %q", tcase.name, data, err, tcase.value)
+		}
+	}
+}
+
+// testCreateIfNotExists tests CreateIfNotExists for a new node, an
+// existing node, and concurrent creators.
+func testCreateIfNotExists(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	conn := Connect(serverAddr)
+	defer conn.Close()
+
+	root := "/test-create-if-not-exists"
+	if _, err := CreateRecursive(ctx, conn, root, nil, 0, zk.WorldACL(PermDirectory), -1); err != nil {
+		t.Fatalf("CreateRecursive failed: %v", err)
+	}
+	aclv := zk.WorldACL(PermFile)
+
+	zkPath := path.Join(root, "node")
+	value, created, err := CreateIfNotExists(ctx, conn, zkPath, []byte("default"), 0, aclv)
+	if err != nil || !created || string(value) != "default" {
+		t.Errorf("CreateIfNotExists on new node: got %q %v %v, want %q true", value, created, err, "default")
+	}
+	value, created, err = CreateIfNotExists(ctx, conn, zkPath, []byte("other"), 0, aclv)
+	if err != nil || created || string(value) != "default" {
+		t.Errorf("CreateIfNotExists on existing node: got %q %v %v, want %q false", value, created, err, "default")
+	}
+
+	// Only one of the concurrent creators creates the node, and
+	// they all get its value back.
+	zkPath = path.Join(root, "concurrent")
+	const creators = 10
+	wg := sync.WaitGroup{}
+	values := make([]string, creators)
+	createdBy := make([]bool, creators)
+	for i := 0; i < creators; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value, c, err := CreateIfNotExists(ctx, conn, zkPath, []byte(fmt.Sprintf("creator%v", i)), 0, aclv)
+			if err != nil {
+				t.Errorf("CreateIfNotExists from creator %v failed: %v", i, err)
+			}
+			values[i], createdBy[i] = string(value), c
+		}(i)
+	}
+	wg.Wait()
+
+	data, _, err := conn.Get(ctx, zkPath)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	createdCount := 0
+	for i := 0; i < creators; i++ {
+		if createdBy[i] {
+			createdCount++
+			if want := fmt.Sprintf("creator%v", i); string(data) != want {
+				t.Errorf("CreateIfNotExists: creator %v created the node, but its value is %q, want %q", i, data, want)
+			}
+		}
+		if values[i] != string(data) {
+			t.Errorf("CreateIfNotExists from creator %v: got value %q, want %q", i, values[i], data)
+		}
+	}
+	if createdCount != 1 {
+		t.Errorf("CreateIfNotExists from %v concurrent creators: got %v created=true, want 1", creators, createdCount)
+	}
+}
+
+// waitForActiveSessions waits until the ZkConnActiveSessions gauge
+// for serverAddr is want.
+func waitForActiveSessions(t *testing.T, serverAddr string, want int64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		got := activeSessions.Counts()[serverAddr]
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v active sessions, got %v", want, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testActiveSessions makes sure the ZkConnActiveSessions gauge goes
+// back to zero once all the connections are closed.
+func testActiveSessions(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+
+	// All the connections of the previous tests are closed.
+	waitForActiveSessions(t, serverAddr, 0)
+
+	conns := make([]*ZkConn, 3)
+	for i := range conns {
+		conns[i] = Connect(serverAddr)
+		if _, _, err := conns[i].Exists(ctx, "/"); err != nil {
+			t.Fatalf("Exists failed: %v", err)
+		}
+	}
+	if got, want := activeSessions.Counts()[serverAddr], int64(len(conns)); got != want {
+		t.Errorf("ZkConnActiveSessions with open connections: got %v, want %v", got, want)
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	waitForActiveSessions(t, serverAddr, 0)
+}
+
+// testExistsMulti tests ExistsMulti with existing, missing and
+// invalid paths, various parallelism values, and a cancelled context.
+func testExistsMulti(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	conn := Connect(serverAddr)
+	defer conn.Close()
+
+	root := "/test-exists-multi"
+	if _, err := CreateRecursive(ctx, conn, root+"/exists", nil, 0, zk.WorldACL(PermFile), -1); err != nil {
+		t.Fatalf("CreateRecursive failed: %v", err)
+	}
+	// The server rejects paths with a NUL character.
+	badPath := root + "/bad\x00path"
+	zkPaths := []string{root + "/exists", root + "/missing", root + "/missing/child", badPath}
+
+	want := map[string]bool{
+		root + "/exists":        true,
+		root + "/missing":       false,
+		root + "/missing/child": false,
+	}
+	for _, parallelism := range []int{-1, 0, 1, 2, 10} {
+		results, errs := ExistsMulti(ctx, conn, zkPaths, parallelism)
+		if !reflect.DeepEqual(results, want) {
+			t.Errorf("ExistsMulti(parallelism=%v): got %v, want %v", parallelism, results, want)
+		}
+		if len(errs) != 1 || errs[badPath] == nil {
+			t.Errorf("ExistsMulti(parallelism=%v): got errors %v, want only one for %q", parallelism, errs, badPath)
+		}
+	}
+
+	// Nothing is checked with a cancelled context.
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	results, errs := ExistsMulti(cancelledCtx, conn, zkPaths, 1)
+	if len(results) != 0 {
+		t.Errorf("ExistsMulti with cancelled context: got results %v, want none", results)
+	}
+	for _, zkPath := range zkPaths {
+		if errs[zkPath] != context.Canceled {
+			t.Errorf("ExistsMulti with cancelled context: got error %v for %q, want %v", errs[zkPath], zkPath, context.Canceled)
+		}
+	}
+}
+
+// testWaitForValue tests WaitForValue with a value that changes after
+// a delay, a node that is created after a delay, and a timeout.
+func testWaitForValue(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	conn := Connect(serverAddr)
+	defer conn.Close()
+
+	root := "/test-wait-for-value"
+	if _, err := CreateRecursive(ctx, conn, root, nil, 0, zk.WorldACL(PermDirectory), -1); err != nil {
+		t.Fatalf("CreateRecursive failed: %v", err)
+	}
+	isReady := func(data []byte) bool {
+		return string(data) == "ready"
+	}
+
+	testcases := []struct {
+		name   string
+		create bool
+	}{{
+		name: "existing",
+	}, {
+		name:   "created-later",
+		create: true,
+	}}
+	for _, tcase := range testcases {
+		zkPath := path.Join(root, tcase.name)
+		if !tcase.create {
+			if _, err := conn.Create(ctx, zkPath, []byte("not ready"), 0, zk.WorldACL(PermFile)); err != nil {
+				t.Fatalf("Create(%v) failed: %v", zkPath, err)
+			}
+		}
+
+		// Flip the value, a few times, after a delay.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			time.Sleep(100 * time.Millisecond)
+			if tcase.create {
+				if _, err := conn.Create(ctx, zkPath, []byte("not ready"), 0, zk.WorldACL(PermFile)); err != nil {
+					t.Errorf("Create(%v) failed: %v", zkPath, err)
+					return
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			for _, value := range []string{"still not ready", "ready"} {
+				if _, err := conn.Set(ctx, zkPath, []byte(value), -1); err != nil {
+					t.Errorf("Set(%v) failed: %v", zkPath, err)
+					return
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+
+		waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		if err := WaitForValue(waitCtx, conn, zkPath, isReady); err != nil {
+			t.Errorf("WaitForValue(%v) failed: %v", tcase.name, err)
+		}
+		cancel()
+		<-done
+	}
+
+	// The value never becomes ready.
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if err := WaitForValue(waitCtx, conn, path.Join(root, "never"), isReady); err != context.DeadlineExceeded {
+		t.Errorf("WaitForValue on node never ready: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// testMulti tests that a Multi transaction is applied entirely, or
+// not at all.
+func testMulti(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	conn := Connect(serverAddr)
+	defer conn.Close()
+
+	root := "/test-multi"
+	if _, err := CreateRecursive(ctx, conn, root+"/existing", []byte("v1"), 0, zk.WorldACL(PermFile), -1); err != nil {
+		t.Fatalf("CreateRecursive failed: %v", err)
+	}
+	_, stat, err := conn.Get(ctx, root+"/existing")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+
+	// All operations succeed.
+	if _, err := conn.Multi(ctx,
+		&zk.CreateRequest{Path: root + "/created", Data: []byte("new"), Acl: zk.WorldACL(PermFile)},
+		&zk.SetDataRequest{Path: root + "/existing", Data: []byte("v2"), Version: stat.Version},
+	); err != nil {
+		t.Fatalf("Multi failed: %v", err)
+	}
+	for zkPath, want := range map[string]string{
+		root + "/created":  "new",
+		root + "/existing": "v2",
+	} {
+		if data, _, err := conn.Get(ctx, zkPath); err != nil || string(data) != want {
+			t.Errorf("Get(%v) after Multi: got %q %v, want %q", zkPath, data, err, want)
+		}
+	}
+
+	// One operation fails, as existing changed since we read
+	// stat: nothing is committed. The vendored client reports it
+	// as zk.ErrAPIError.
+	if _, err := conn.Multi(ctx,
+		&zk.CreateRequest{Path: root + "/not-created", Data: []byte("new"), Acl: zk.WorldACL(PermFile)},
+		&zk.SetDataRequest{Path: root + "/created", Data: []byte("changed"), Version: -1},
+		&zk.CheckVersionRequest{Path: root + "/existing", Version: stat.Version},
+	); err != zk.ErrAPIError {
+		t.Errorf("Multi with bad version: got %v, want %v", err, zk.ErrAPIError)
+	}
+	if exists, _, err := conn.Exists(ctx, root+"/not-created"); err != nil || exists {
+		t.Errorf("Exists after failed Multi: got %v %v, want false", exists, err)
+	}
+	if data, _, err := conn.Get(ctx, root+"/created"); err != nil || string(data) != "new" {
+		t.Errorf("Get after failed Multi: got %q %v, want %q", data, err, "new")
+	}
+}
+
+// testAuth makes sure a ZkConn created with -topo_zk_auth_file can
+// read a node protected by a digest ACL, and one created without
+// can't.
+func testAuth(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+
+	f, err := ioutil.TempFile("", "zk_auth")
+	if err != nil {
+		t.Fatalf("TempFile failed: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("digest:user:pass"); err != nil {
+		t.Fatalf("WriteString failed: %v", err)
+	}
+	f.Close()
+
+	defer func(saved string) { *authFile = saved }(*authFile)
+	*authFile = f.Name()
+	authConn := Connect(serverAddr)
+	defer authConn.Close()
+	*authFile = ""
+	noAuthConn := Connect(serverAddr)
+	defer noAuthConn.Close()
+
+	zkPath := "/test-auth/secret"
+	if _, err := CreateRecursive(ctx, authConn, path.Dir(zkPath), nil, 0, zk.WorldACL(PermDirectory), -1); err != nil {
+		t.Fatalf("CreateRecursive failed: %v", err)
+	}
+	if _, err := authConn.Create(ctx, zkPath, []byte("secret"), 0, zk.DigestACL(zk.PermAll, "user", "pass")); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	if data, _, err := authConn.Get(ctx, zkPath); err != nil || string(data) != "secret" {
+		t.Errorf("Get with auth: got %q %v, want %q", data, err, "secret")
+	}
+	if _, _, err := noAuthConn.Get(ctx, zkPath); err != zk.ErrNoAuth {
+		t.Errorf("Get without auth: got %v, want %v", err, zk.ErrNoAuth)
+	}
+}
+
+// testNumChildren compares NumChildren with the number of children
+// returned by Children.
+func testNumChildren(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	conn := Connect(serverAddr)
+	defer conn.Close()
+
+	root := "/test-num-children"
+	if _, err := CreateRecursive(ctx, conn, root, nil, 0, zk.WorldACL(PermDirectory), -1); err != nil {
+		t.Fatalf("CreateRecursive failed: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if i > 0 {
+			if _, err := conn.Create(ctx, path.Join(root, fmt.Sprintf("child%v", i)), nil, 0, zk.WorldACL(PermFile)); err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+		}
+		children, _, err := conn.Children(ctx, root)
+		if err != nil {
+			t.Fatalf("Children failed: %v", err)
+		}
+		if got, err := NumChildren(ctx, conn, root); err != nil || got != len(children) {
+			t.Errorf("NumChildren: got %v %v, want %v", got, err, len(children))
+		}
+	}
+
+	if _, err := NumChildren(ctx, conn, root+"/missing"); err != zk.ErrNoNode {
+		t.Errorf("NumChildren on missing node: got %v, want %v", err, zk.ErrNoNode)
+	}
+}
+
+// testChangedChildren makes sure ChangedChildren only returns the
+// children modified after the provided zxid.
+func testChangedChildren(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	conn := Connect(serverAddr)
+	defer conn.Close()
+
+	root := "/test-changed-children"
+	children := []string{"a", "b", "c", "d", "e"}
+	for _, child := range children {
+		if _, err := CreateRecursive(ctx, conn, path.Join(root, child), []byte("v1"), 0, zk.WorldACL(PermFile), -1); err != nil {
+			t.Fatalf("CreateRecursive(%v) failed: %v", child, err)
+		}
+	}
+
+	// The last created child was modified at sinceMzxid, not after.
+	_, stat, err := conn.Exists(ctx, path.Join(root, "e"))
+	if err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+	sinceMzxid := stat.Mzxid
+
+	testcases := []struct {
+		since int64
+		want  []string
+	}{
+		{0, children},
+		{sinceMzxid - 1, []string{"e"}},
+		{sinceMzxid, []string{}},
+	}
+	for _, tcase := range testcases {
+		got, err := ChangedChildren(ctx, conn, root, tcase.since, 0)
+		if err != nil || !reflect.DeepEqual(got, tcase.want) {
+			t.Errorf("ChangedChildren(%v) before changes: got %v %v, want %v", tcase.since, got, err, tcase.want)
+		}
+	}
+
+	// Only the modified children are returned.
+	for _, child := range []string{"d", "b"} {
+		if _, err := conn.Set(ctx, path.Join(root, child), []byte("v2"), -1); err != nil {
+			t.Fatalf("Set(%v) failed: %v", child, err)
+		}
+	}
+	want := []string{"b", "d"}
+	for _, parallelism := range []int{-1, 1, 3} {
+		got, err := ChangedChildren(ctx, conn, root, sinceMzxid, parallelism)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ChangedChildren(parallelism=%v) after changes: got %v %v, want %v", parallelism, got, err, want)
+		}
+	}
+}
+
+// testDialStats makes sure a successful dial is counted in
+// ZkConnDialSuccesses and timed in ZkConnDialTimings.
+func testDialStats(t *testing.T, serverAddr string) {
+	ctx := context.Background()
+	successesBefore := dialSuccesses.Counts()[serverAddr]
+	timingsBefore := dialTimings.Counts()[serverAddr]
+	errorsBefore := dialErrors.Counts()[serverAddr]
+
+	conn := Connect(serverAddr)
+	defer conn.Close()
+	if _, _, err := conn.Exists(ctx, "/"); err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+
+	if got, want := dialSuccesses.Counts()[serverAddr], successesBefore+1; got != want {
+		t.Errorf("ZkConnDialSuccesses[%v] = %v, want %v", serverAddr, got, want)
+	}
+	if got, want := dialTimings.Counts()[serverAddr], timingsBefore+1; got != want {
+		t.Errorf("ZkConnDialTimings[%v] count = %v, want %v", serverAddr, got, want)
+	}
+	if h := dialTimings.Histograms()[serverAddr]; h == nil || h.Total() <= 0 {
+		t.Errorf("ZkConnDialTimings[%v] has no recorded duration: %v", serverAddr, h)
+	}
+	if got := dialErrors.Counts()[serverAddr]; got != errorsBefore {
+		t.Errorf("ZkConnDialErrors[%v] = %v, want %v", serverAddr, got, errorsBefore)
+	}
+}
@@ -17,17 +17,21 @@ limitations under the License.
 package zk2topo
 
 import (
+	"encoding/json"
 	"fmt"
 	"path"
 	"sort"
 	"strings"
 	"sync"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/samuel/go-zookeeper/zk"
 	"golang.org/x/net/context"
 	"vitess.io/vitess/go/vt/log"
 
 	"vitess.io/vitess/go/fileutil"
+	"vitess.io/vitess/go/json2"
+	"vitess.io/vitess/go/tb"
 )
 
 // CreateRecursive is a helper function on top of Create. It will
@@ -58,6 +62,28 @@ func CreateRecursive(ctx context.Context, conn *ZkConn, zkPath string, value []b
 	return pathCreated, err
 }
 
+// CreateIfNotExists creates the node at zkPath with defaultValue, or
+// returns its current value if it already exists. created is true only
+// for the caller that actually created the node.
+func CreateIfNotExists(ctx context.Context, zconn *ZkConn, zkPath string, defaultValue []byte, flags int32, aclv []zk.ACL) (value []byte, created bool, err error) {
+	for i := 0; i < maxChangeAttempts; i++ {
+		_, err = zconn.Create(ctx, zkPath, defaultValue, flags, aclv)
+		if err == nil {
+			return defaultValue, true, nil
+		}
+		if err != zk.ErrNodeExists {
+			return nil, false, err
+		}
+
+		value, _, err = zconn.Get(ctx, zkPath)
+		if err != zk.ErrNoNode {
+			return value, false, err
+		}
+		// The node was deleted in the meantime, try creating it again.
+	}
+	return nil, false, fmt.Errorf("CreateIfNotExists: node %v keeps being created and deleted", zkPath)
+}
+
 // ChildrenRecursive returns the relative path of all the children of
 // the provided node.
 func ChildrenRecursive(ctx context.Context, zconn *ZkConn, zkPath string) ([]string, error) {
@@ -105,6 +131,219 @@ func ChildrenRecursive(ctx context.Context, zconn *ZkConn, zkPath string) ([]str
 	return pathList, nil
 }
 
+// defaultParallelism is the number of concurrent requests the
+// multi-path helpers use when the caller doesn't specify one.
+const defaultParallelism = 16
+
+// forEachParallel calls f for all the provided names, from at most
+// parallelism go routines at once, and waits for all calls to be done.
+// It returns the errors returned by f, keyed by name. A panic in f is
+// recovered, and returned as the error for that name. Once ctx is
+// done, f is not called any more, and the remaining names get
+// ctx.Err().
+func forEachParallel(ctx context.Context, names []string, parallelism int, f func(name string) error) map[string]error {
+	if parallelism <= 0 {
+		parallelism = defaultParallelism
+	}
+
+	mu := sync.Mutex{}
+	errs := make(map[string]error)
+	wg := sync.WaitGroup{}
+	c := make(chan string)
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range c {
+				if err := callRecovered(f, name); err != nil {
+					mu.Lock()
+					errs[name] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	i := 0
+feed:
+	for ; i < len(names); i++ {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break feed
+		case c <- names[i]:
+		}
+	}
+	close(c)
+	wg.Wait()
+
+	for _, name := range names[i:] {
+		errs[name] = ctx.Err()
+	}
+	return errs
+}
+
+// callRecovered returns f(name), or an error if f panics.
+func callRecovered(f func(name string) error, name string) (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			log.Errorf("uncaught panic processing %v: %v\n%s", name, x, tb.Stack(4))
+			err = fmt.Errorf("uncaught panic processing %v: %v", name, x)
+		}
+	}()
+	return f(name)
+}
+
+// firstError returns the error of the first of names that has one
+// in errs, or nil.
+func firstError(names []string, errs map[string]error) error {
+	for _, name := range names {
+		if err := errs[name]; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChildrenMulti returns the children of all the provided paths,
+// running at most parallelism Children calls at once. A failure on
+// one path doesn't abort the others: the error is returned in the
+// second map, keyed by path. Once ctx is done, the paths not read
+// yet get ctx.Err().
+func ChildrenMulti(ctx context.Context, zconn *ZkConn, zkPaths []string, parallelism int) (map[string][]string, map[string]error) {
+	mu := sync.Mutex{}
+	results := make(map[string][]string, len(zkPaths))
+	errs := forEachParallel(ctx, zkPaths, parallelism, func(zkPath string) error {
+		children, _, err := zconn.Children(ctx, zkPath)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		results[zkPath] = children
+		mu.Unlock()
+		return nil
+	})
+	return results, errs
+}
+
+// ExistsMulti checks if all the provided paths exist, running at
+// most parallelism Exists calls at once. A missing node is reported
+// as false, not as an error. Other failures don't abort the other
+// paths: the error is returned in the second map, keyed by path.
+// Once ctx is done, the paths not checked yet get ctx.Err().
+func ExistsMulti(ctx context.Context, zconn *ZkConn, zkPaths []string, parallelism int) (map[string]bool, map[string]error) {
+	mu := sync.Mutex{}
+	results := make(map[string]bool, len(zkPaths))
+	errs := forEachParallel(ctx, zkPaths, parallelism, func(zkPath string) error {
+		exists, _, err := zconn.Exists(ctx, zkPath)
+		if err != nil && err != zk.ErrNoNode {
+			return err
+		}
+		mu.Lock()
+		results[zkPath] = exists && err == nil
+		mu.Unlock()
+		return nil
+	})
+	return results, errs
+}
+
+// ChildrenWithData returns the data of all the children of zkPath,
+// keyed by child name. It reads at most parallelism children at once.
+// Children deleted between the listing and the read are omitted.
+func ChildrenWithData(ctx context.Context, zconn *ZkConn, zkPath string, parallelism int) (map[string][]byte, error) {
+	children, _, err := zconn.Children(ctx, zkPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mu := sync.Mutex{}
+	result := make(map[string][]byte, len(children))
+	errs := forEachParallel(ctx, children, parallelism, func(child string) error {
+		data, _, err := zconn.Get(ctx, path.Join(zkPath, child))
+		switch err {
+		case nil:
+			mu.Lock()
+			result[child] = data
+			mu.Unlock()
+		case zk.ErrNoNode:
+			// The child was deleted in the meantime.
+		default:
+			return err
+		}
+		return nil
+	})
+
+	if err := firstError(children, errs); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// NumChildren returns the number of children of zkPath. It reads
+// it from the node stat, so it doesn't transfer the children names.
+func NumChildren(ctx context.Context, zconn *ZkConn, zkPath string) (int, error) {
+	exists, stat, err := zconn.Exists(ctx, zkPath)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, zk.ErrNoNode
+	}
+	return int(stat.NumChildren), nil
+}
+
+// ListEphemeralChildren returns the sorted names of the children of
+// zkPath that are ephemeral nodes, like locks or election proposals.
+// It reads at most parallelism children stats at once.
+// Children deleted while we look at them are omitted.
+func ListEphemeralChildren(ctx context.Context, zconn *ZkConn, zkPath string, parallelism int) ([]string, error) {
+	return filterChildren(ctx, zconn, zkPath, parallelism, func(stat *zk.Stat) bool {
+		return stat.EphemeralOwner != 0
+	})
+}
+
+// ChangedChildren returns the sorted names of the children of zkPath
+// that were modified after the transaction sinceMzxid. Pollers can
+// pass the highest Mzxid they have seen to only get the changes.
+// It reads at most parallelism children stats at once.
+// Children deleted while we look at them are omitted.
+func ChangedChildren(ctx context.Context, zconn *ZkConn, zkPath string, sinceMzxid int64, parallelism int) ([]string, error) {
+	return filterChildren(ctx, zconn, zkPath, parallelism, func(stat *zk.Stat) bool {
+		return stat.Mzxid > sinceMzxid
+	})
+}
+
+// filterChildren returns the sorted names of the children of zkPath
+// whose stat matches keep. It reads at most parallelism stats at once.
+func filterChildren(ctx context.Context, zconn *ZkConn, zkPath string, parallelism int, keep func(stat *zk.Stat) bool) ([]string, error) {
+	children, _, err := zconn.Children(ctx, zkPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mu := sync.Mutex{}
+	result := make([]string, 0, len(children))
+	errs := forEachParallel(ctx, children, parallelism, func(child string) error {
+		exists, stat, err := zconn.Exists(ctx, path.Join(zkPath, child))
+		if err != nil {
+			return err
+		}
+		if exists && keep(stat) {
+			mu.Lock()
+			result = append(result, child)
+			mu.Unlock()
+		}
+		return nil
+	})
+
+	if err := firstError(children, errs); err != nil {
+		return nil, err
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
 // ResolveWildcards resolves paths like:
 // /zk/nyc/vt/tablets/*/action
 // /zk/global/vt/keyspaces/*/shards/*/action
@@ -284,6 +523,138 @@ func DeleteRecursive(ctx context.Context, zconn *ZkConn, zkPath string, version
 	return err
 }
 
+// GetJSON reads the node at zkPath and unmarshals its JSON contents
+// into out. It returns the version of the node.
+func GetJSON(ctx context.Context, zconn *ZkConn, zkPath string, out interface{}) (int32, error) {
+	data, stat, err := zconn.Get(ctx, zkPath)
+	if err != nil {
+		return 0, err
+	}
+	if err := json2.Unmarshal(data, out); err != nil {
+		return 0, fmt.Errorf("GetJSON: invalid JSON in %v: %v", zkPath, err)
+	}
+	return stat.Version, nil
+}
+
+// SetJSON marshals v to JSON and writes it to the node at zkPath.
+// Like in GetJSON, protos are marshaled with jsonpb.
+// Pass version=-1 to overwrite any version of the node.
+func SetJSON(ctx context.Context, zconn *ZkConn, zkPath string, v interface{}, version int32) error {
+	var data []byte
+	var err error
+	if pb, ok := v.(proto.Message); ok {
+		data, err = json2.MarshalPB(pb)
+	} else {
+		data, err = json.Marshal(v)
+	}
+	if err != nil {
+		return fmt.Errorf("SetJSON: cannot marshal value for %v: %v", zkPath, err)
+	}
+	_, err = zconn.Set(ctx, zkPath, data, version)
+	return err
+}
+
+// maxChangeAttempts is how many times CompareAndSet, RetryChange and
+// CreateIfNotExists access a node before giving up on conflicts.
+const maxChangeAttempts = 10
+
+// CompareAndSet reads the node at zkPath, computes its new value with
+// transform, and writes it back only if the node was not modified in
+// between. On a version conflict, it reads the node again and retries.
+// An error returned by transform aborts the loop and is returned as is.
+func CompareAndSet(ctx context.Context, zconn *ZkConn, zkPath string, transform func(oldValue []byte, version int32) ([]byte, error)) error {
+	for i := 0; i < maxChangeAttempts; i++ {
+		data, stat, err := zconn.Get(ctx, zkPath)
+		if err != nil {
+			return err
+		}
+		newValue, err := transform(data, stat.Version)
+		if err != nil {
+			return err
+		}
+		_, err = zconn.Set(ctx, zkPath, newValue, stat.Version)
+		if err != zk.ErrBadVersion {
+			return err
+		}
+	}
+	return fmt.Errorf("CompareAndSet: too many version conflicts on %v", zkPath)
+}
+
+// RetryChange sets the node at zkPath to the value returned by
+// changeFunc, creating it with flags and aclv if it doesn't exist.
+// changeFunc is called with the current value and stat, or nil
+// values if the node doesn't exist. If the node is concurrently
+// modified, created or deleted, it is read again and changeFunc is
+// called again. An error returned by changeFunc aborts the loop and
+// is returned as is.
+func RetryChange(ctx context.Context, zconn *ZkConn, zkPath string, flags int32, aclv []zk.ACL, changeFunc func(oldValue []byte, stat *zk.Stat) ([]byte, error)) error {
+	for i := 0; i < maxChangeAttempts; i++ {
+		data, stat, err := zconn.Get(ctx, zkPath)
+		switch err {
+		case nil:
+		case zk.ErrNoNode:
+			data, stat = nil, nil
+		default:
+			return err
+		}
+
+		newValue, err := changeFunc(data, stat)
+		if err != nil {
+			return err
+		}
+
+		if stat == nil {
+			_, err = zconn.Create(ctx, zkPath, newValue, flags, aclv)
+			if err != zk.ErrNodeExists {
+				return err
+			}
+		} else {
+			_, err = zconn.Set(ctx, zkPath, newValue, stat.Version)
+			if err != zk.ErrBadVersion && err != zk.ErrNoNode {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("RetryChange: too many conflicts on %v", zkPath)
+}
+
+// WaitForValue waits until the node at zkPath exists and its data
+// satisfies predicate, or until ctx is done. Between checks, it
+// watches the node, or its creation if it doesn't exist yet.
+// If the watch is lost with the session, it is set again on the
+// next check.
+func WaitForValue(ctx context.Context, zconn *ZkConn, zkPath string, predicate func(data []byte) bool) error {
+	for {
+		data, _, watch, err := zconn.GetW(ctx, zkPath)
+		switch err {
+		case nil:
+			if predicate(data) {
+				return nil
+			}
+		case zk.ErrNoNode:
+			var exists bool
+			exists, _, watch, err = zconn.ExistsW(ctx, zkPath)
+			if err != nil {
+				return err
+			}
+			if exists {
+				// The node was just created, read it again.
+				continue
+			}
+		default:
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-watch:
+			// Something happened to the node, or the
+			// session was lost. Either way, check again.
+		}
+	}
+}
+
 // obtainQueueLock waits until we hold the lock in the provided path.
 // The lexically lowest node is the lock holder - verify that this
 // path holds the lock.  Call this queue-lock because the semantics are
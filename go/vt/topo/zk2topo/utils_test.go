@@ -0,0 +1,70 @@
+/*
+Copyright 2018 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zk2topo
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestForEachParallel(t *testing.T) {
+	names := []string{"a", "b", "panic", "error", "c", "d"}
+	errFailed := errors.New("failed")
+
+	for _, parallelism := range []int{-1, 0, 1, 2, 10} {
+		mu := sync.Mutex{}
+		var called []string
+		errs := forEachParallel(context.Background(), names, parallelism, func(name string) error {
+			mu.Lock()
+			called = append(called, name)
+			mu.Unlock()
+			switch name {
+			case "panic":
+				panic("worker panic")
+			case "error":
+				return errFailed
+			}
+			return nil
+		})
+
+		// A panic doesn't stop the other names from being processed.
+		sort.Strings(called)
+		if got, want := strings.Join(called, ","), "a,b,c,d,error,panic"; got != want {
+			t.Errorf("forEachParallel(parallelism=%v): called for %v, want %v", parallelism, got, want)
+		}
+		if len(errs) != 2 || errs["error"] != errFailed || errs["panic"] == nil || !strings.Contains(errs["panic"].Error(), "worker panic") {
+			t.Errorf("forEachParallel(parallelism=%v): got errors %v, want %v for error and a panic error for panic", parallelism, errs, errFailed)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	errs := forEachParallel(ctx, names, 1, func(name string) error {
+		t.Errorf("forEachParallel with cancelled context: called for %v", name)
+		return nil
+	})
+	for _, name := range names {
+		if errs[name] != context.Canceled {
+			t.Errorf("forEachParallel with cancelled context: got %v for %v, want %v", errs[name], name, context.Canceled)
+		}
+	}
+}
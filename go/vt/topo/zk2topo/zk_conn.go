@@ -19,11 +19,13 @@ package zk2topo
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -32,16 +34,13 @@ import (
 	"golang.org/x/net/context"
 
 	"vitess.io/vitess/go/netutil"
+	"vitess.io/vitess/go/stats"
 	"vitess.io/vitess/go/sync2"
+	"vitess.io/vitess/go/trace"
 	"vitess.io/vitess/go/vt/log"
 )
 
 const (
-	// maxAttempts is how many times we retry queries.  At 2 for
-	// now, so if a query fails because the session expired, we
-	// just try to reconnect once and go on.
-	maxAttempts = 2
-
 	// PermDirectory are default permissions for a node.
 	PermDirectory = zk.PermAdmin | zk.PermCreate | zk.PermDelete | zk.PermRead | zk.PermWrite
 
@@ -51,15 +50,39 @@ const (
 )
 
 var (
+	// maxAttempts is how many times we retry queries.  At 2 by
+	// default, so if a query fails because the session expired, we
+	// just try to reconnect once and go on. Values below 1 are
+	// treated as 1.
+	maxAttempts = flag.Int("topo_zk_max_attempts", 2, "maximum number of attempts for a zk query, reconnecting in between if the connection could not be established or was closed.")
+
+	baseRetryBackoff = flag.Duration("topo_zk_base_retry_backoff", time.Second, "base backoff between zk query attempts, doubled at each attempt up to topo_zk_max_retry_backoff, before the random jitter is added.")
+	maxRetryBackoff  = flag.Duration("topo_zk_max_retry_backoff", 30*time.Second, "maximum base backoff between zk query attempts, before the random jitter is added.")
+
 	maxConcurrency = flag.Int("topo_zk_max_concurrency", 64, "maximum number of pending requests to send to a Zookeeper server.")
 
 	baseTimeout = flag.Duration("topo_zk_base_timeout", 30*time.Second, "zk base timeout (see zk.Connect)")
 
+	defaultPort = flag.Int("topo_zk_default_port", 2181, "port to use for zk servers listed without one")
+
 	certPath = flag.String("topo_zk_tls_cert", "", "the cert to use to connect to the zk topo server, requires topo_zk_tls_key, enables TLS")
 	keyPath  = flag.String("topo_zk_tls_key", "", "the key to use to connect to the zk topo server, enables TLS")
 	caPath   = flag.String("topo_zk_tls_ca", "", "the server ca to use to validate servers when connecting to the zk topo server")
+
+	authFile = flag.String("topo_zk_auth_file", "", "auth to use when connecting to the zk topo server, file contents should be <scheme>:<auth>, e.g., digest:user:pass")
+
+	// Connection statistics, per Zookeeper address.
+	dialSuccesses      = stats.NewCountersWithSingleLabel("ZkConnDialSuccesses", "Successful zk connection attempts", "Addr")
+	dialErrors         = stats.NewCountersWithSingleLabel("ZkConnDialErrors", "Failed zk connection attempts", "Addr")
+	sessionExpirations = stats.NewCountersWithSingleLabel("ZkConnSessionExpirations", "Expired zk sessions", "Addr")
+	dialTimings        = stats.NewTimings("ZkConnDialTimings", "Time it took to establish zk sessions", "Addr")
+	activeSessions     = stats.NewGaugesWithSingleLabel("ZkConnActiveSessions", "Number of open zk sessions", "Addr")
 )
 
+// ErrConnClosed is returned by the ZkConn methods once Close has
+// been called.
+var ErrConnClosed = errors.New("zk conn: connection was closed")
+
 // Time returns a time.Time from a ZK int64 milliseconds since Epoch time.
 func Time(i int64) time.Time {
 	return time.Unix(i/1000, i%1000*1000000)
@@ -86,17 +109,48 @@ type ZkConn struct {
 	sem *sync2.Semaphore
 
 	// mu protects the following fields.
-	mu   sync.Mutex
-	conn *zk.Conn
+	mu     sync.Mutex
+	conn   *zk.Conn
+	closed bool
+
+	// dialing is set while a go routine is dialing the servers,
+	// without holding mu. Other callers wait for that dial and
+	// share its result, or give up when their context is done.
+	dialing *dialResult
+
+	// dial is dialZk, except in tests.
+	dial func(ctx context.Context, addr string) (*zk.Conn, <-chan zk.Event, error)
+
+	// auth is the auth info from -topo_zk_auth_file, read once in
+	// Connect. authErr is set instead if that file is invalid.
+	auth    *zkAuth
+	authErr error
+}
+
+// dialResult is the outcome of a dial. done is closed when the dial
+// is over, err is only set when it failed, and is immutable after done
+// is closed.
+type dialResult struct {
+	done chan struct{}
+	err  error
 }
 
 // Connect to the Zookeeper servers specified in addr
 // addr can be a comma separated list of servers and each server can be a DNS entry with multiple values.
 // Connects to the endpoints in a randomized order to avoid hot spots.
+// The auth file, if any, is read here: if it is invalid, all the
+// ZkConn methods fail with that error.
 func Connect(addr string) *ZkConn {
+	auth, err := parseAuthFile(*authFile)
+	if err != nil {
+		log.Errorf("zk conn: %v, all queries to addr %v will fail", err, addr)
+	}
 	return &ZkConn{
-		addr: addr,
-		sem:  sync2.NewSemaphore(*maxConcurrency, 0),
+		addr:    addr,
+		sem:     sync2.NewSemaphore(*maxConcurrency, 0),
+		dial:    dialZk,
+		auth:    auth,
+		authErr: err,
 	}
 }
 
@@ -196,13 +250,31 @@ func (c *ZkConn) SetACL(ctx context.Context, path string, aclv []zk.ACL, version
 	})
 }
 
+// Multi is part of the Conn interface.
+// It runs all the provided operations (*zk.CreateRequest,
+// *zk.DeleteRequest, *zk.SetDataRequest or *zk.CheckVersionRequest)
+// in a single transaction: either all of them succeed, or none is applied.
+// Note the go-zookeeper client we use can't decode the per-operation
+// results of a failed transaction: the error is then always
+// zk.ErrAPIError, and doesn't say which operation failed, nor why.
+// Callers need to read the nodes again to find out.
+func (c *ZkConn) Multi(ctx context.Context, ops ...interface{}) (responses []zk.MultiResponse, err error) {
+	err = c.withRetry(ctx, func(conn *zk.Conn) error {
+		responses, err = conn.Multi(ops...)
+		return err
+	})
+	return
+}
+
 // Close is part of the Conn interface.
 func (c *ZkConn) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.conn != nil {
 		c.conn.Close()
+		c.conn = nil
 	}
+	c.closed = true
 	return nil
 }
 
@@ -220,25 +292,50 @@ func (c *ZkConn) Close() error {
 //
 // https://issues.apache.org/jira/browse/ZOOKEEPER-22
 func (c *ZkConn) withRetry(ctx context.Context, action func(conn *zk.Conn) error) (err error) {
+	// No point in trying without the configured auth.
+	if c.authErr != nil {
+		return c.authErr
+	}
 
 	// Handle concurrent access to a Zookeeper server here.
-	c.sem.Acquire()
+	if !c.sem.AcquireContext(ctx) {
+		return ctx.Err()
+	}
 	defer c.sem.Release()
 
-	for i := 0; i < maxAttempts; i++ {
+	// We always need to run the action at least once, or we'd
+	// return neither a result nor an error.
+	attempts := *maxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	connectFailed := false
+	for i := 0; i < attempts; i++ {
 		if i > 0 {
-			// Add a bit of backoff time before retrying:
-			// 1 second base + up to 5 seconds.
-			time.Sleep(1*time.Second + time.Duration(rand.Int63n(5e9)))
+			// Add a bit of backoff time before retrying.
+			// Give up early if the context is done.
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(retryBackoff(i)):
+			}
 		}
 
 		// Get the current connection, or connect.
 		var conn *zk.Conn
 		conn, err = c.getConn(ctx)
+		if err == ErrConnClosed {
+			// No point in trying again.
+			return
+		}
 		if err != nil {
 			// We can't connect, try again.
+			log.Warningf("zk conn: connect attempt %v/%v to addr %v failed: %v", i+1, attempts, c.addr, err)
+			connectFailed = true
 			continue
 		}
+		connectFailed = false
 
 		// Execute the action.
 		err = action(conn)
@@ -249,60 +346,173 @@ func (c *ZkConn) withRetry(ctx context.Context, action func(conn *zk.Conn) error
 		}
 
 		// We got an error, because the connection was closed.
-		// Let's clear up our errored connection and try again.
+		// Let's clear up our errored connection and try again,
+		// unless it was closed by Close.
+		c.dropConn(conn)
 		c.mu.Lock()
-		if c.conn == conn {
-			c.conn = nil
-		}
+		closed := c.closed
 		c.mu.Unlock()
+		if closed {
+			return ErrConnClosed
+		}
+	}
+	if connectFailed {
+		if ctx.Err() != nil {
+			// Return context errors as is, so callers can
+			// still map them to topo.Timeout or topo.Interrupted.
+			return ctx.Err()
+		}
+		err = fmt.Errorf("zk conn: cannot connect to addr %v after %v attempts: %v", c.addr, attempts, err)
 	}
 	return
 }
 
+// retryBackoff returns how long to wait before the provided retry
+// attempt (1 for the first retry): *baseRetryBackoff, doubled at each
+// attempt up to *maxRetryBackoff, + up to 5 seconds of jitter.
+func retryBackoff(attempt int) time.Duration {
+	backoff := *baseRetryBackoff
+	for i := 1; i < attempt && backoff < *maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > *maxRetryBackoff {
+		backoff = *maxRetryBackoff
+	}
+	return backoff + time.Duration(rand.Int63n(5e9))
+}
+
 // getConn returns the connection in a thread safe way. It will try to connect
-// if not connected yet.
+// if not connected yet. The dial is done without holding mu, so a
+// caller waiting for another go routine's dial returns ctx.Err() as
+// soon as its own context is done. If that dial fails, all its
+// waiters get its error.
 func (c *ZkConn) getConn(ctx context.Context) (*zk.Conn, error) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	for {
+		if c.closed {
+			c.mu.Unlock()
+			return nil, ErrConnClosed
+		}
+		if c.conn != nil {
+			conn := c.conn
+			c.mu.Unlock()
+			return conn, nil
+		}
+		if c.dialing == nil {
+			break
+		}
 
-	if c.conn == nil {
-		conn, events, err := dialZk(ctx, c.addr)
-		if err != nil {
-			return nil, err
+		// Someone else is dialing, wait for them.
+		dialing := c.dialing
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-dialing.done:
+		}
+
+		// Share the dial error, so the caller backs off before
+		// trying again, instead of dialing again right away.
+		// If the dial was cancelled by its caller's context, it
+		// says nothing about the servers: dial ourselves.
+		switch dialing.err {
+		case nil, context.Canceled, context.DeadlineExceeded:
+		default:
+			return nil, dialing.err
 		}
-		c.conn = conn
-		go c.handleSessionEvents(conn, events)
+		c.mu.Lock()
+	}
+
+	// We're the one dialing.
+	dialing := &dialResult{
+		done: make(chan struct{}),
+	}
+	c.dialing = dialing
+	c.mu.Unlock()
+
+	span := trace.NewSpanFromContext(ctx)
+	span.StartClient("ZkConn.Dial")
+	span.Annotate("addr", c.addr)
+	startTime := time.Now()
+	conn, events, err := c.dial(ctx, c.addr)
+	if err == nil && c.auth != nil {
+		if err = conn.AddAuth(c.auth.scheme, c.auth.auth); err != nil {
+			conn.Close()
+			err = fmt.Errorf("zk AddAuth with scheme %v failed: %v", c.auth.scheme, err)
+		}
+	}
+	span.Finish()
+
+	c.mu.Lock()
+	c.dialing = nil
+	dialing.err = err
+	close(dialing.done)
+	if err != nil {
+		c.mu.Unlock()
+		dialErrors.Add(c.addr, 1)
+		return nil, err
+	}
+	dialSuccesses.Add(c.addr, 1)
+	dialTimings.Record(c.addr, startTime)
+	if c.closed {
+		// Close was called while we were dialing.
+		c.mu.Unlock()
+		conn.Close()
+		return nil, ErrConnClosed
 	}
-	return c.conn, nil
+	c.conn = conn
+	c.mu.Unlock()
+
+	activeSessions.Add(c.addr, 1)
+	go c.handleSessionEvents(conn, events)
+	return conn, nil
+}
+
+// dropConn clears out the connection record if it still is conn, and
+// then closes conn. It returns false if someone else already did.
+// This way, the zk library connection is closed exactly once.
+func (c *ZkConn) dropConn(conn *zk.Conn) bool {
+	c.mu.Lock()
+	if c.conn != conn {
+		c.mu.Unlock()
+		return false
+	}
+	c.conn = nil
+	c.mu.Unlock()
+	conn.Close()
+	return true
 }
 
 // handleSessionEvents is processing events from the session channel.
 // When it detects that the connection is not working any more, it
-// clears out the connection record.
+// drops the connection. It returns when the zk library closes the
+// session channel, which only happens once the connection is closed
+// and the library stopped trying to reconnect it.
 func (c *ZkConn) handleSessionEvents(conn *zk.Conn, session <-chan zk.Event) {
-	for event := range session {
-		closeRequired := false
+	defer activeSessions.Add(c.addr, -1)
 
+	for event := range session {
 		switch event.State {
-		case zk.StateExpired, zk.StateConnecting:
-			closeRequired = true
-			fallthrough
-		case zk.StateDisconnected:
-			c.mu.Lock()
-			if c.conn == conn {
-				// The ZkConn still references this
-				// connection, let's nil it.
-				c.conn = nil
+		case zk.StateExpired, zk.StateConnecting, zk.StateDisconnected:
+			if event.State == zk.StateExpired {
+				sessionExpirations.Add(c.addr, 1)
 			}
-			c.mu.Unlock()
-			if closeRequired {
-				conn.Close()
+			if c.dropConn(conn) {
+				log.Warningf("zk conn: session for addr %v ended: %v", c.addr, event)
 			}
-			log.Infof("zk conn: session for addr %v ended: %v", c.addr, event)
-			return
+		default:
+			log.Infof("zk conn: session for addr %v event: %v", c.addr, event)
 		}
-		log.Infof("zk conn: session for addr %v event: %v", c.addr, event)
 	}
+
+	// The session channel was closed while we still use the
+	// connection, it is unusable: make sure we don't keep it.
+	c.mu.Lock()
+	if c.conn == conn {
+		log.Warningf("zk conn: session channel for addr %v closed unexpectedly", c.addr)
+		c.conn = nil
+	}
+	c.mu.Unlock()
 }
 
 // dialZk dials the server, and waits until connection.
@@ -319,7 +529,10 @@ func dialZk(ctx context.Context, addr string) (*zk.Conn, <-chan zk.Event, error)
 			log.Fatalf("This TLS zk code requires that the all the zk servers validate to a single server name.")
 		}
 
-		serverName := strings.Split(addr, ":")[0]
+		serverName, _, err := net.SplitHostPort(withDefaultPort(addr))
+		if err != nil {
+			log.Fatalf("Unable to parse zk server address %v: %v", addr, err)
+		}
 
 		log.Infof("Using TLS ZK, connecting to %v server name %v", addr, serverName)
 		cert, err := tls.LoadX509KeyPair(*certPath, *keyPath)
@@ -377,21 +590,73 @@ func dialZk(ctx context.Context, addr string) (*zk.Conn, <-chan zk.Event, error)
 	}
 }
 
+// zkAuth is the auth info to add to the connections.
+type zkAuth struct {
+	scheme string
+	auth   []byte
+}
+
+// parseAuthFile reads the auth info from file, which contains
+// <scheme>:<auth>. It returns nil if file is empty.
+func parseAuthFile(file string) (*zkAuth, error) {
+	if file == "" {
+		return nil, nil
+	}
+	authInfo, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read zk auth file %v: %v", file, err)
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(authInfo)), ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid zk auth file %v, expected <scheme>:<auth>", file)
+	}
+	return &zkAuth{
+		scheme: parts[0],
+		auth:   []byte(parts[1]),
+	}, nil
+}
+
 // resolveZkAddr takes a comma-separated list of host:port addresses,
 // and resolves the host to replace it with the IP address.
 // If a resolution fails, the host is skipped.
+// Duplicate addresses are only returned once.
 // If no host can be resolved, an error is returned.
 // This is different from the Zookeeper library, that insists on resolving
 // *all* hosts successfully before it starts.
 func resolveZkAddr(zkAddr string) ([]string, error) {
 	parts := strings.Split(zkAddr, ",")
 	resolved := make([]string, 0, len(parts))
+	seen := make(map[string]bool)
+	add := func(addrs ...string) {
+		for _, addr := range addrs {
+			if !seen[addr] {
+				seen[addr] = true
+				resolved = append(resolved, addr)
+			}
+		}
+	}
 	for _, part := range parts {
-		// The Zookeeper client cannot handle IPv6 addresses before version 3.4.x.
+		part = withDefaultPort(part)
+
+		// Literal IPv6 addresses, like [2001:db8::1]:2181, are
+		// used as is: they were explicitly requested.
+		if host, port, err := net.SplitHostPort(part); err == nil {
+			if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+				if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+					log.Warningf("invalid port in %v, will not use it", part)
+				} else {
+					add(part)
+				}
+				continue
+			}
+		}
+
+		// Host names are only resolved to IPv4 addresses:
+		// the Zookeeper client cannot handle IPv6 addresses before version 3.4.x.
 		if r, err := netutil.ResolveIPv4Addrs(part); err != nil {
 			log.Warningf("cannot resolve %v, will not use it: %v", part, err)
 		} else {
-			resolved = append(resolved, r...)
+			add(r...)
 		}
 	}
 	if len(resolved) == 0 {
@@ -399,3 +664,15 @@ func resolveZkAddr(zkAddr string) ([]string, error) {
 	}
 	return resolved, nil
 }
+
+// withDefaultPort appends the default Zookeeper port to a server
+// address that doesn't have one, like 'host' or '[2001:db8::1]'.
+// Any other address is returned unchanged.
+func withDefaultPort(addr string) string {
+	_, _, err := net.SplitHostPort(addr)
+	if addrErr, ok := err.(*net.AddrError); !ok || addrErr.Err != "missing port in address" {
+		return addr
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	return net.JoinHostPort(host, strconv.Itoa(*defaultPort))
+}
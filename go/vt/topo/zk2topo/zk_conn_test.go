@@ -0,0 +1,475 @@
+/*
+Copyright 2018 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zk2topo
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+	"golang.org/x/net/context"
+
+	"vitess.io/vitess/go/sync2"
+	"vitess.io/vitess/go/trace"
+	"vitess.io/vitess/go/vt/topo"
+)
+
+func TestResolveZkAddr(t *testing.T) {
+	testcases := []struct {
+		addr string
+		want []string
+		err  bool
+	}{{
+		addr: "127.0.0.1:2181",
+		want: []string{"127.0.0.1:2181"},
+	}, {
+		addr: "[2001:db8::1]:2181",
+		want: []string{"[2001:db8::1]:2181"},
+	}, {
+		addr: "127.0.0.1:2181,[2001:db8::1]:2182,[::1]:2183",
+		want: []string{"127.0.0.1:2181", "[2001:db8::1]:2182", "[::1]:2183"},
+	}, {
+		addr: "[::ffff:127.0.0.1]:2181",
+		want: []string{"127.0.0.1:2181"},
+	}, {
+		addr: "127.0.0.1",
+		want: []string{"127.0.0.1:2181"},
+	}, {
+		addr: "[2001:db8::1]",
+		want: []string{"[2001:db8::1]:2181"},
+	}, {
+		addr: "127.0.0.1:2182,127.0.0.2,[2001:db8::1],[2001:db8::2]:2183",
+		want: []string{"127.0.0.1:2182", "127.0.0.2:2181", "[2001:db8::1]:2181", "[2001:db8::2]:2183"},
+	}, {
+		addr: "127.0.0.1:2181,127.0.0.2:2181,127.0.0.1:2181,127.0.0.2,[::1]:2181,[::1]:2181",
+		want: []string{"127.0.0.1:2181", "127.0.0.2:2181", "[::1]:2181"},
+	}, {
+		addr: "[2001:db8::1:2181",
+		err:  true,
+	}, {
+		addr: "[::1]:",
+		err:  true,
+	}, {
+		addr: "[::1]:zk",
+		err:  true,
+	}, {
+		addr: "[::1]:2181,[::2]:",
+		want: []string{"[::1]:2181"},
+	}}
+	for _, tcase := range testcases {
+		got, err := resolveZkAddr(tcase.addr)
+		if tcase.err {
+			if err == nil {
+				t.Errorf("resolveZkAddr(%v): got %v, want error", tcase.addr, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveZkAddr(%v) failed: %v", tcase.addr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tcase.want) {
+			t.Errorf("resolveZkAddr(%v): got %v, want %v", tcase.addr, got, tcase.want)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	defer func(saved time.Duration) { *baseRetryBackoff = saved }(*baseRetryBackoff)
+
+	testcases := []struct {
+		base    time.Duration
+		attempt int
+		min     time.Duration
+	}{
+		{time.Second, 1, 1 * time.Second},
+		{time.Second, 2, 2 * time.Second},
+		{time.Second, 3, 4 * time.Second},
+		{time.Second, 5, 16 * time.Second},
+		{time.Second, 6, *maxRetryBackoff},
+		{time.Second, 100, *maxRetryBackoff},
+		{100 * time.Millisecond, 1, 100 * time.Millisecond},
+		{100 * time.Millisecond, 4, 800 * time.Millisecond},
+		{10 * time.Second, 2, 20 * time.Second},
+		{10 * time.Second, 3, *maxRetryBackoff},
+		{time.Minute, 1, *maxRetryBackoff},
+	}
+	for _, tcase := range testcases {
+		*baseRetryBackoff = tcase.base
+		got := retryBackoff(tcase.attempt)
+		if got < tcase.min || got >= tcase.min+5*time.Second {
+			t.Errorf("retryBackoff(%v) with base %v: got %v, want in [%v, %v)", tcase.attempt, tcase.base, got, tcase.min, tcase.min+5*time.Second)
+		}
+	}
+}
+
+// deadAddr returns the address of a local port nobody listens on.
+func deadAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestGetConnContextWhileDialing(t *testing.T) {
+	c := Connect(deadAddr(t))
+	defer c.Close()
+
+	// The first caller dials the dead server, and is stuck there
+	// until its context is done.
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer dialCancel()
+	go c.Get(dialCtx, "/")
+	for {
+		c.mu.Lock()
+		dialing := c.dialing != nil
+		c.mu.Unlock()
+		if dialing {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A second caller should give up with its own deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := c.Get(ctx, "/"); err != context.DeadlineExceeded {
+		t.Errorf("Get while dialing: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Get while dialing took %v, expected it to return after its 200ms deadline", d)
+	}
+}
+
+func TestWithRetrySemaphoreContext(t *testing.T) {
+	c := &ZkConn{
+		addr: deadAddr(t),
+		sem:  sync2.NewSemaphore(1, 0),
+	}
+	c.sem.Acquire()
+	defer c.sem.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, _, err := c.Get(ctx, "/"); err != context.DeadlineExceeded {
+		t.Errorf("Get with no semaphore slot: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestWithRetryAttempts(t *testing.T) {
+	defer func(saved int) { *maxAttempts = saved }(*maxAttempts)
+
+	for _, attempts := range []int{-1, 0, 1} {
+		*maxAttempts = attempts
+		c := Connect(deadAddr(t))
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		called := false
+		err := c.withRetry(ctx, func(conn *zk.Conn) error {
+			called = true
+			return nil
+		})
+		cancel()
+		c.Close()
+
+		// The action can't run against a dead server, so we
+		// need an error, and it should still be a context error.
+		if called || err != context.DeadlineExceeded {
+			t.Errorf("withRetry with %v attempts: got called=%v err=%v, want %v", attempts, called, err, context.DeadlineExceeded)
+		}
+		if !topo.IsErrType(convertError(err, "/"), topo.Timeout) {
+			t.Errorf("withRetry with %v attempts: convertError(%v) is not a topo.Timeout", attempts, err)
+		}
+	}
+}
+
+func TestGetConnSharesDialError(t *testing.T) {
+	addr := "shared-dial-error:2181"
+	c := Connect(addr)
+	defer c.Close()
+
+	dialErr := errors.New("dial failed")
+	release := make(chan struct{})
+	var mu sync.Mutex
+	dials := 0
+	c.dial = func(ctx context.Context, addr string) (*zk.Conn, <-chan zk.Event, error) {
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		<-release
+		return nil, nil, dialErr
+	}
+	dialErrorsBefore := dialErrors.Counts()[addr]
+
+	const callers = 20
+	wg := sync.WaitGroup{}
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = c.getConn(context.Background())
+		}(i)
+	}
+
+	// Let all the callers wait for the first dial, then fail it.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if dials != 1 {
+		t.Errorf("concurrent getConn: got %v dials, want 1", dials)
+	}
+	if got := dialErrors.Counts()[addr] - dialErrorsBefore; got != 1 {
+		t.Errorf("concurrent getConn: got %v ZkConnDialErrors, want 1", got)
+	}
+	for i, err := range errs {
+		if err != dialErr {
+			t.Errorf("concurrent getConn %v: got %v, want %v", i, err, dialErr)
+		}
+	}
+}
+
+func TestDialErrorStats(t *testing.T) {
+	defer func(saved int) { *maxAttempts = saved }(*maxAttempts)
+	*maxAttempts = 1
+
+	addr := deadAddr(t)
+	c := Connect(addr)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, _, err := c.Get(ctx, "/"); err == nil {
+		t.Fatalf("Get on dead server worked")
+	}
+	if got := dialErrors.Counts()[addr]; got != 1 {
+		t.Errorf("ZkConnDialErrors for %v: got %v, want 1", addr, got)
+	}
+	if got := dialSuccesses.Counts()[addr]; got != 0 {
+		t.Errorf("ZkConnDialSuccesses for %v: got %v, want 0", addr, got)
+	}
+}
+
+// writeAuthFile writes contents to a temporary file, and returns its
+// name.
+func writeAuthFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "zk_auth")
+	if err != nil {
+		t.Fatalf("TempFile failed: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatalf("WriteString failed: %v", err)
+	}
+	return f.Name()
+}
+
+func TestParseAuthFile(t *testing.T) {
+	testcases := []struct {
+		contents string
+		want     *zkAuth
+	}{{
+		contents: "digest:user:pass\n",
+		want:     &zkAuth{scheme: "digest", auth: []byte("user:pass")},
+	}, {
+		contents: "world:anyone",
+		want:     &zkAuth{scheme: "world", auth: []byte("anyone")},
+	}, {
+		contents: "digest",
+	}, {
+		contents: ":user:pass",
+	}, {
+		contents: "",
+	}}
+	for _, tcase := range testcases {
+		file := writeAuthFile(t, tcase.contents)
+		defer os.Remove(file)
+
+		got, err := parseAuthFile(file)
+		if tcase.want == nil {
+			if err == nil {
+				t.Errorf("parseAuthFile(%q): got %v, want error", tcase.contents, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tcase.want) {
+			t.Errorf("parseAuthFile(%q): got %v %v, want %v", tcase.contents, got, err, tcase.want)
+		}
+	}
+
+	if got, err := parseAuthFile(""); got != nil || err != nil {
+		t.Errorf("parseAuthFile(\"\"): got %v %v, want nil nil", got, err)
+	}
+	if _, err := parseAuthFile("/nonexistent/zk_auth"); err == nil {
+		t.Errorf("parseAuthFile on missing file: got no error")
+	}
+}
+
+func TestConnectInvalidAuthFile(t *testing.T) {
+	file := writeAuthFile(t, "nocolon")
+	defer os.Remove(file)
+	defer func(saved string) { *authFile = saved }(*authFile)
+	*authFile = file
+
+	c := Connect(deadAddr(t))
+	defer c.Close()
+	c.dial = func(ctx context.Context, addr string) (*zk.Conn, <-chan zk.Event, error) {
+		t.Errorf("dial called with an invalid auth file")
+		return nil, nil, errors.New("should not dial")
+	}
+	if _, _, err := c.Get(context.Background(), "/"); err == nil || err != c.authErr {
+		t.Errorf("Get with invalid auth file: got %v, want the auth file error", err)
+	}
+}
+
+// testSpanFactory is a trace.SpanFactory that records all the spans.
+type testSpanFactory struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+var spans = &testSpanFactory{}
+
+func init() {
+	// Registered before the tests run, as the trace package
+	// doesn't protect the factory against concurrent accesses.
+	trace.RegisterSpanFactory(spans)
+}
+
+func (f *testSpanFactory) New(parent trace.Span) trace.Span {
+	span := &testSpan{
+		annotations: make(map[string]interface{}),
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.spans = append(f.spans, span)
+	return span
+}
+
+func (f *testSpanFactory) FromContext(ctx context.Context) (trace.Span, bool) {
+	return nil, false
+}
+
+func (f *testSpanFactory) NewContext(parent context.Context, span trace.Span) context.Context {
+	return parent
+}
+
+// find returns the span with the provided label and annotation.
+func (f *testSpanFactory) find(label, key string, value interface{}) *testSpan {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, span := range f.spans {
+		span.mu.Lock()
+		found := span.label == label && span.annotations[key] == value
+		span.mu.Unlock()
+		if found {
+			return span
+		}
+	}
+	return nil
+}
+
+type testSpan struct {
+	mu          sync.Mutex
+	label       string
+	client      bool
+	finished    bool
+	annotations map[string]interface{}
+}
+
+func (s *testSpan) StartLocal(label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.label = label
+}
+
+func (s *testSpan) StartClient(label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.label = label
+	s.client = true
+}
+
+func (s *testSpan) StartServer(label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.label = label
+}
+
+func (s *testSpan) Finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finished = true
+}
+
+func (s *testSpan) Annotate(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.annotations[key] = value
+}
+
+func TestDialSpan(t *testing.T) {
+	addr := deadAddr(t)
+	c := Connect(addr)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	c.Get(ctx, "/")
+
+	span := spans.find("ZkConn.Dial", "addr", addr)
+	if span == nil {
+		t.Fatalf("no ZkConn.Dial span for addr %v", addr)
+	}
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	if !span.client || !span.finished {
+		t.Errorf("ZkConn.Dial span: got client=%v finished=%v, want a finished client span", span.client, span.finished)
+	}
+}
+
+func TestHandleSessionEventsChannelClosed(t *testing.T) {
+	addr := "closed-session-channel:2181"
+	c := Connect(addr)
+
+	// The zk.Conn is never used, as there is no terminal event.
+	conn := &zk.Conn{}
+	c.conn = conn
+	activeSessions.Add(addr, 1)
+
+	session := make(chan zk.Event, 1)
+	session <- zk.Event{Type: zk.EventSession, State: zk.StateHasSession}
+	close(session)
+	c.handleSessionEvents(conn, session)
+
+	if c.conn != nil {
+		t.Errorf("connection still used after its session channel was closed")
+	}
+	if got := activeSessions.Counts()[addr]; got != 0 {
+		t.Errorf("ZkConnActiveSessions after the session channel was closed: got %v, want 0", got)
+	}
+}